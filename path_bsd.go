@@ -0,0 +1,47 @@
+// +build dragonfly freebsd netbsd openbsd
+
+package notify
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+// errRenameTargetNotFound is returned by resolveRenamedPath when no entry
+// in oldParent has the expected inode, typically because the rename moved
+// the watched node out of oldParent entirely rather than just renaming it
+// in place.
+var errRenameTargetNotFound = errors.New("kqueue: renamed path not found")
+
+// resolveRenamedPath re-derives the current path of a renamed watch by
+// scanning oldParent for the entry whose inode now matches ino. Unlike
+// Darwin's F_GETPATH, BSD kqueue gives no direct way to recover a path from
+// an fd, so this only resolves renames that keep the watched node in the
+// same parent directory -- the atomic-replace pattern editors and package
+// managers routinely use.
+func resolveRenamedPath(fd int, ino uint64, oldParent string) (string, error) {
+	dir, err := os.Open(oldParent)
+	if err != nil {
+		return "", err
+	}
+	defer dir.Close()
+	names, err := dir.Readdirnames(-1)
+	if err != nil {
+		return "", err
+	}
+	for _, name := range names {
+		p := filepath.Join(oldParent, name)
+		fi, err := os.Lstat(p)
+		if err != nil {
+			continue
+		}
+		st, ok := fi.Sys().(*syscall.Stat_t)
+		if !ok || uint64(st.Ino) != ino {
+			continue
+		}
+		return p, nil
+	}
+	return "", errRenameTargetNotFound
+}
@@ -0,0 +1,34 @@
+// +build darwin
+
+package notify
+
+import (
+	"syscall"
+	"unsafe"
+)
+
+// fcntlGetPath is F_GETPATH from <fcntl.h>, used to recover the current
+// path backing an open file descriptor. Darwin keeps a kqueue watch's fd
+// pointing at the renamed file across a rename, so this is all that is
+// needed to resolve where it went.
+const fcntlGetPath = 50
+
+// maxPathLen is PATH_MAX on Darwin, the largest buffer F_GETPATH can fill.
+const maxPathLen = 1024
+
+// resolveRenamedPath asks the kernel for the current path of `fd`. `ino`
+// and `oldParent` are unused on Darwin; they exist only so the function has
+// the same signature as its BSD counterpart, which has no equivalent to
+// F_GETPATH and must re-derive the path by other means.
+func resolveRenamedPath(fd int, ino uint64, oldParent string) (string, error) {
+	var buf [maxPathLen]byte
+	_, _, errno := syscall.Syscall(syscall.SYS_FCNTL, uintptr(fd), uintptr(fcntlGetPath), uintptr(unsafe.Pointer(&buf[0])))
+	if errno != 0 {
+		return "", errno
+	}
+	n := 0
+	for n < len(buf) && buf[n] != 0 {
+		n++
+	}
+	return string(buf[:n]), nil
+}
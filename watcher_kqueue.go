@@ -9,14 +9,68 @@ import (
 	"path/filepath"
 	"sync"
 	"syscall"
+	"time"
 )
 
-// TODO: Close fd on exit.
-// TODO: Close kqueue fd on exit.
 // TODO: Take into account currently monitored files with those read from dir.
 // TODO: Write whole bunch of additional tests (which btw most likely won't
 //       pass by default...).
 
+const (
+	// maxRecurseDepth bounds how many directory levels WatchRecursive will
+	// descend into from its root, guarding against pathologically deep or
+	// cyclical trees.
+	maxRecurseDepth = 128
+	// maxWatchFds bounds the number of file descriptors kqueue will hold
+	// open for watched files/directories across all watches, recursive or
+	// not.
+	maxWatchFds = 8192
+	// defaultKeventBufSize is the default number of events monitor() asks
+	// the kernel for per syscall.Kevent call. A single event per call
+	// becomes a measurable bottleneck on directories under heavy churn,
+	// since every burst entry costs its own syscall round trip.
+	defaultKeventBufSize = 64
+	// errBufSize is the capacity of the errs channel. It lets a burst of
+	// failures queue up behind a caller that is slow to drain Errors(),
+	// instead of the first one stalling monitor() immediately.
+	errBufSize = 64
+	// maintenanceInterval bounds how long monitor()'s Kevent call blocks
+	// when there is nothing to report, so it can also service periodic
+	// upkeep -- currently fd health checks -- without a second goroutine.
+	maintenanceInterval = time.Second
+)
+
+// errFdBudgetExceeded is returned when adding a new watch would push the
+// number of open watch file descriptors past maxWatchFds.
+var errFdBudgetExceeded = errors.New("kqueue: file descriptor budget exceeded")
+
+// errMissingWatch is reported on Errors() when monitor() reads a kevent for
+// an identifier that has no corresponding entry in idLkp, which otherwise
+// used to panic and take down the whole process.
+var errMissingWatch = errors.New("kqueue: missing config for event")
+
+// Error is sent on the channel returned by Errors() for a failure
+// encountered while monitoring a watched path, so that other watches can
+// keep being served instead of the whole process going down. Path is empty
+// and Kevent may be incomplete when the failure cannot be attributed to a
+// specific watch, such as errMissingWatch.
+type Error struct {
+	// Path is the watched path the failure relates to, if any.
+	Path string
+	// Kevent is the kevent being processed when the failure occurred.
+	Kevent *syscall.Kevent_t
+	// Err is the underlying error.
+	Err error
+}
+
+// Error implements the error interface.
+func (e *Error) Error() string {
+	if e.Path == "" {
+		return e.Err.Error()
+	}
+	return e.Path + ": " + e.Err.Error()
+}
+
 // event is a struct storing reported event's data.
 type event struct {
 	// dir specifies if event relates to directory.
@@ -27,6 +81,9 @@ type event struct {
 	e Event
 	// k is `syscall.Kevent_t` instance representing reported event.
 	k *syscall.Kevent_t
+	// rename carries the old/new path pair for a resolved NOTE_RENAME.
+	// It is nil for every other event.
+	rename *RenameEvent
 }
 
 // Event returns type of a reported event.
@@ -38,20 +95,63 @@ func (e *event) IsDir() bool { return e.dir }
 // Name returns path to file/directory for which event is reported.
 func (e *event) Name() string { return e.p }
 
-// Sys returns platform specific object describing reported event.
-// If event generated by internal implementation, it returns nil.
-func (e *event) Sys() interface{} { return e.k }
+// Sys returns platform specific object describing reported event. For a
+// resolved Rename event it returns a *RenameEvent; otherwise, if generated
+// from a kevent, the underlying `syscall.Kevent_t`; otherwise nil.
+func (e *event) Sys() interface{} {
+	if e.rename != nil {
+		return e.rename
+	}
+	return e.k
+}
+
+// RenameEvent is the Sys() value of a Rename EventInfo. It lets a caller
+// correlate the two halves of an atomic-replace pattern (e.g.
+// `mv foo.conf foo.conf.bak && mv new foo.conf`) instead of seeing two
+// unrelated paths come and go.
+type RenameEvent struct {
+	// OldPath is the path the watch was registered under before the
+	// rename.
+	OldPath string
+	// NewPath is the path it was resolved to afterwards.
+	NewPath string
+}
 
 // newWatcher returns `kqueue` Watcher implementation.
 func newWatcher() Watcher {
-	k := &kqueue{
-		idLkp:  make(map[int]*watched, 0),
-		pthLkp: make(map[string]*watched, 0),
-		c:      make(chan EventInfo),
+	return newKqueue(defaultKeventBufSize)
+}
+
+// NewWatcherSize returns a `kqueue` Watcher like the package-level
+// NewWatcher, but requesting up to bufSize events per syscall.Kevent call
+// in monitor() instead of defaultKeventBufSize. bufSize <= 0 is equivalent
+// to NewWatcher. Larger sizes amortize the syscall cost of a directory
+// under heavy churn at the expense of a bigger per-call buffer.
+func NewWatcherSize(bufSize int) Watcher {
+	return newKqueue(bufSize)
+}
+
+// newKqueue allocates a kqueue Watcher with the given event buffer size.
+func newKqueue(bufSize int) *kqueue {
+	if bufSize <= 0 {
+		bufSize = defaultKeventBufSize
+	}
+	return &kqueue{
+		idLkp:   make(map[int]*watched, 0),
+		pthLkp:  make(map[string]*watched, 0),
+		c:       make(chan EventInfo),
+		closed:  make(chan struct{}),
+		errs:    make(chan error, errBufSize),
+		bufSize: bufSize,
 	}
-	return k
 }
 
+// wakeupIdent is the identifier of the EVFILT_USER event registered by init
+// and triggered by Close to deterministically unblock the syscall.Kevent
+// call blocked in monitor(), since closing the fds being watched does not
+// reliably do so on its own.
+const wakeupIdent = 0
+
 // monitor reads reported kqueue events and forwards them further after
 // performing additional processing. If read event concerns directory,
 // it generates Create/Delete event and sent them further instead of directory
@@ -60,58 +160,94 @@ func newWatcher() Watcher {
 // Reading directory structure is less accurate than kqueue and can lead
 // to lack of detection of all events.
 func (k *kqueue) monitor() {
+	kevbuf := make([]syscall.Kevent_t, k.bufSize)
+	timeout := syscall.NsecToTimespec(maintenanceInterval.Nanoseconds())
 	for {
-		var kevn [1]syscall.Kevent_t
-		n, err := syscall.Kevent(*k.fd, nil, kevn[:], nil)
+		n, err := syscall.Kevent(*k.fd, nil, kevbuf, &timeout)
 		// ignore failure to capture an event.
 		if err != nil {
 			continue
 		}
-		if n > 0 {
-			k.Lock()
-			w := k.idLkp[int(kevn[0].Ident)]
+		if n == 0 {
+			// Kevent timed out rather than returning an event; use the idle
+			// moment to run periodic upkeep instead of needing a second
+			// goroutine ticking alongside monitor().
+			k.maintain()
+			continue
+		}
+		k.Lock()
+		for i := 0; i < n; i++ {
+			// Copy the kevent out of kevbuf: the next Kevent call reuses the
+			// buffer, and kevn outlives it through event.k and Error.Kevent.
+			kevn := new(syscall.Kevent_t)
+			*kevn = kevbuf[i]
+			if kevn.Filter == syscall.EVFILT_USER {
+				k.Unlock()
+				close(k.closed)
+				return
+			}
+			w := k.idLkp[int(kevn.Ident)]
 			if w == nil {
-				panic("kqueue: missing config for event")
+				k.reportError(&Error{Kevent: kevn, Err: errMissingWatch})
+				continue
 			}
 			if w.dir {
 				// If it's dir and delete we have to send it and continue, because
 				// other processing relies on opening (in this case not existing) dir.
-				if (Event(kevn[0].Fflags) & NOTE_DELETE) != 0 {
-					k.c <- &event{w.dir, w.p, Event(kevn[0].Fflags), &kevn[0]}
+				if (Event(kevn.Fflags) & NOTE_DELETE) != 0 {
+					k.deliver(w, w.p, Event(kevn.Fflags), kevn, nil)
 					delete(k.idLkp, w.fd)
 					delete(k.pthLkp, w.p)
-					k.Unlock()
+					syscall.Close(w.fd)
+					continue
+				}
+				// A rename of the watched directory itself, as opposed to one of
+				// its children; resolve it once instead of walking its current
+				// contents, which say nothing about the rename.
+				if (Event(kevn.Fflags) & NOTE_RENAME) != 0 {
+					k.handleRename(w, kevn)
 					continue
 				}
 				if err := k.walk(w.p, func(fi os.FileInfo) error {
 					p := filepath.Join(w.p, fi.Name())
-					if (Event(kevn[0].Fflags) & NOTE_WRITE) != 0 {
-						if err := k.watch(p, w.eDir, false, fi.IsDir()); err != nil {
+					if (Event(kevn.Fflags) & NOTE_WRITE) != 0 {
+						if w.recursive && fi.IsDir() {
+							// watchTree succeeds for an already-watched subdirectory
+							// too, so only a path not yet in pthLkp is a Create.
+							_, known := k.pthLkp[p]
+							if err := k.watchTree(p, w.eDir, w.depth+1); err != nil {
+								if err != errNoNewWatch {
+									k.reportError(&Error{Path: p, Kevent: kevn, Err: err})
+								}
+							} else if !known {
+								k.c <- &event{w.dir, p, Create, nil, nil}
+							}
+						} else if err := k.watch(p, w.eDir, false, fi.IsDir()); err != nil {
 							if err != errNoNewWatch {
-								// TODO: pass error via chan because state of monitoring is
-								// invalid.
-								panic(err)
+								k.reportError(&Error{Path: p, Kevent: kevn, Err: err})
 							}
 						} else {
-							k.c <- &event{w.dir, p, Create, nil}
+							k.c <- &event{w.dir, p, Create, nil, nil}
 						}
 					} else {
-						k.c <- &event{w.dir, w.p, Event(kevn[0].Fflags), &kevn[0]}
+						k.deliver(w, w.p, Event(kevn.Fflags), kevn, nil)
 					}
 					return nil
 				}); err != nil {
-					// TODO: pass error via chan because state of monitoring is invalid.
-					panic(err)
+					k.reportError(&Error{Path: w.p, Kevent: kevn, Err: err})
 				}
+			} else if (Event(kevn.Fflags) & NOTE_RENAME) != 0 {
+				k.handleRename(w, kevn)
 			} else {
-				k.c <- &event{w.dir, w.p, Event(kevn[0].Fflags), &kevn[0]}
+				k.deliver(w, w.p, Event(kevn.Fflags), kevn, nil)
 			}
-			if (Event(kevn[0].Fflags) & NOTE_DELETE) != 0 {
+			if (Event(kevn.Fflags) & NOTE_DELETE) != 0 {
 				delete(k.idLkp, w.fd)
 				delete(k.pthLkp, w.p)
+				syscall.Close(w.fd)
 			}
-			k.Unlock()
 		}
+		k.Unlock()
 	}
 }
 
@@ -128,6 +264,50 @@ type kqueue struct {
 	pthLkp map[string]*watched
 	// c is a channel used to pass events further.
 	c chan EventInfo
+	// pendMu guards pend. It is a separate lock from the kqueue's own
+	// Mutex so that a debounce timer firing from its own goroutine never
+	// has to contend with monitor() holding the kqueue lock.
+	pendMu sync.Mutex
+	// pend maps a debounced path to its not-yet-delivered coalesced event.
+	pend map[string]*pending
+	// closeMu guards fd and closing for Close's own bookkeeping. It is
+	// deliberately not the kqueue's own Mutex: monitor() can be blocked
+	// sending on k.c (or k.errs, before reportError existed) while holding
+	// that lock, and Close must be able to start tearing down without
+	// waiting on whatever is -- or isn't -- draining those channels.
+	closeMu sync.Mutex
+	// closing is set once Close has begun tearing the watcher down, so a
+	// second Close call is a no-op instead of triggering the wakeup again
+	// and closing the same descriptors twice.
+	closing bool
+	// closed is closed by monitor() once it observes the EVFILT_USER
+	// wakeup triggered by Close, signalling that it is safe to close fds.
+	closed chan struct{}
+	// errs is the channel returned by Errors(), carrying failures that
+	// monitor() would otherwise have paniced on.
+	errs chan error
+	// bufSize is the number of events monitor() requests per Kevent call.
+	// Defaults to defaultKeventBufSize.
+	bufSize int
+}
+
+// Errors implements `Watcher` interface. It returns a channel of *Error
+// values describing failures encountered while monitoring watched paths,
+// such as a transient Open failure rescanning a directory whose permissions
+// changed. The channel is buffered and reported errors are dropped once
+// that buffer fills, so an undrained Errors() degrades to losing errors
+// rather than wedging monitor() -- and anything holding k.Lock() behind it,
+// including Close() -- on a send nobody is there to receive.
+func (k *kqueue) Errors() <-chan error { return k.errs }
+
+// reportError sends e on the channel returned by Errors() without blocking.
+// If errs is full, e is dropped; see the Errors() doc for why that is
+// preferable to blocking monitor() or maintain() while they hold k.Lock().
+func (k *kqueue) reportError(e *Error) {
+	select {
+	case k.errs <- e:
+	default:
+	}
 }
 
 // watched is a data structure representing wached file/directory.
@@ -142,6 +322,33 @@ type watched struct {
 	eDir Event
 	// eNonDir represents events wached indirectly.
 	eNonDir Event
+	// recursive indicates this directory was registered through
+	// WatchRecursive, so newly created subdirectories discovered under it
+	// must themselves be watched recursively.
+	recursive bool
+	// depth is the number of directory levels between this watch and the
+	// root passed to WatchRecursive, used to enforce maxRecurseDepth.
+	depth int
+	// delay is the debounce window set up through WatchWithDelay. Zero
+	// means events for this path are delivered as they arrive.
+	delay time.Duration
+	// ino is the inode number `p` had when the watch was opened, used by
+	// resolveRenamedPath to re-identify it by inode on platforms that
+	// cannot recover a path from an fd directly.
+	ino uint64
+}
+
+// coalesceMask is the set of events that are coalesced by a WatchWithDelay
+// debounce window rather than delivered immediately. NOTE_DELETE and
+// NOTE_RENAME always flush and bypass the window, since downstream
+// consumers need to know about those right away.
+const coalesceMask = NOTE_WRITE | NOTE_EXTEND | NOTE_ATTRIB
+
+// pending holds a not-yet-delivered, coalesced event for a debounced path.
+type pending struct {
+	dir   bool
+	e     Event
+	timer *time.Timer
 }
 
 // init initializes kqueu if not yet initialized.
@@ -153,11 +360,104 @@ func (k *kqueue) init() (err error) {
 			return
 		}
 		k.fd = &fd
+		var kevn [1]syscall.Kevent_t
+		syscall.SetKevent(&kevn[0], wakeupIdent, syscall.EVFILT_USER, syscall.EV_ADD|syscall.EV_CLEAR)
+		if _, err = syscall.Kevent(fd, kevn[:], nil, nil); err != nil {
+			return
+		}
 		go k.monitor()
 	}
 	return
 }
 
+// maintain runs periodic upkeep when monitor()'s Kevent call times out with
+// nothing to report. It fstats every watched fd so a descriptor that has
+// gone stale out from under idLkp -- rather than through a NOTE_DELETE
+// kqueue told us about -- is still caught and reported on Errors().
+func (k *kqueue) maintain() {
+	k.Lock()
+	defer k.Unlock()
+	var st syscall.Stat_t
+	for fd, w := range k.idLkp {
+		if err := syscall.Fstat(fd, &st); err != nil {
+			k.reportError(&Error{Path: w.p, Err: err})
+		}
+	}
+}
+
+// Close implements `Watcher` interface. It closes every file descriptor
+// opened for a watched file/directory, then the kqueue descriptor itself,
+// waking the blocking syscall.Kevent call in monitor() via the EVFILT_USER
+// event registered in init() so monitor() can observe the shutdown and
+// return deterministically rather than relying on fd-close semantics.
+// Close is a no-op if the watcher was never started or is already closed.
+func (k *kqueue) Close() error {
+	k.closeMu.Lock()
+	if k.fd == nil || k.closing {
+		k.closeMu.Unlock()
+		return nil
+	}
+	k.closing = true
+	fd := *k.fd
+	k.closeMu.Unlock()
+
+	var kevn [1]syscall.Kevent_t
+	syscall.SetKevent(&kevn[0], wakeupIdent, syscall.EVFILT_USER, syscall.EV_ONESHOT)
+	kevn[0].Fflags = uint32(syscall.NOTE_TRIGGER)
+	if _, err := syscall.Kevent(fd, kevn[:], nil, nil); err != nil {
+		return err
+	}
+
+	// Drain k.c concurrently with waiting for the wakeup to land: monitor()
+	// may currently be blocked sending an event while holding k.Lock(), and
+	// it cannot reach the EVFILT_USER branch -- so k.closed never closes --
+	// until that send has a receiver.
+	drained := make(chan struct{})
+	go func() {
+		defer close(drained)
+		for {
+			select {
+			case <-k.c:
+			case <-k.closed:
+				return
+			}
+		}
+	}()
+	<-k.closed
+	<-drained
+
+	k.Lock()
+	defer k.Unlock()
+	for fd := range k.idLkp {
+		syscall.Close(fd)
+	}
+	k.idLkp = make(map[int]*watched)
+	k.pthLkp = make(map[string]*watched)
+	err := syscall.Close(fd)
+	k.closeMu.Lock()
+	k.fd = nil
+	k.closeMu.Unlock()
+
+	// Stop every outstanding debounce timer. Left running, one could still
+	// fire after this point and call flushDelayed, which sends on k.c with
+	// no receiver left to drain it -- a permanent goroutine leak.
+	k.pendMu.Lock()
+	for p, pe := range k.pend {
+		pe.timer.Stop()
+		delete(k.pend, p)
+	}
+	k.pendMu.Unlock()
+drain:
+	for {
+		select {
+		case <-k.c:
+		default:
+			break drain
+		}
+	}
+	return err
+}
+
 // Watch implements Watcher interface.
 // TODO: Maybe go one more time if called on already watched dir? Or maybe not?
 func (k *kqueue) Watch(p string, e Event) error {
@@ -193,6 +493,155 @@ func (k *kqueue) Watch(p string, e Event) error {
 	return nil
 }
 
+// WatchRecursive starts watching `p` and, if it is a directory, every
+// subdirectory beneath it up to maxRecurseDepth levels deep. Subdirectories
+// created later under a recursively watched tree are picked up automatically
+// as `monitor` observes NOTE_WRITE on their parent; their removal is handled
+// the same way plain directory watches are, through NOTE_DELETE on the
+// watch's own fd. Symlinks are never followed, to avoid turning a cycle back
+// into an ancestor directory into an unbounded recursion. Once the number of
+// open watch descriptors would exceed maxWatchFds, watching fails with
+// errFdBudgetExceeded and whatever was already watched stays in place.
+func (k *kqueue) WatchRecursive(p string, e Event) error {
+	if err := k.init(); err != nil {
+		return err
+	}
+	dir, err := isdir(p)
+	if err != nil {
+		return err
+	}
+	if !dir {
+		return k.Watch(p, e)
+	}
+	return k.watchTree(p, e, 0)
+}
+
+// watchTree registers a watch on `p` at the given recursion depth and, if
+// `p` is a directory, descends into its non-symlink children.
+func (k *kqueue) watchTree(p string, e Event, depth int) error {
+	if depth > maxRecurseDepth {
+		return nil
+	}
+	if err := k.watch(p, e, true, true); err != nil && err != errNoNewWatch {
+		return err
+	}
+	// Reached whether `p` was newly watched or already was -- an existing,
+	// non-recursive watch (e.g. from a prior plain Watch) must still be
+	// promoted, or subdirectories created under it later are never picked up.
+	if w := k.pthLkp[p]; w != nil {
+		w.recursive, w.depth = true, depth
+	}
+	return k.walk(p, func(fi os.FileInfo) error {
+		if fi.Mode()&os.ModeSymlink != 0 {
+			return nil
+		}
+		cp := filepath.Join(p, fi.Name())
+		if fi.IsDir() {
+			return k.watchTree(cp, e, depth+1)
+		}
+		if err := k.watch(cp, e, false, false); err != nil && err != errNoNewWatch {
+			return err
+		}
+		return nil
+	})
+}
+
+// WatchWithDelay behaves like Watch, but coalesces bursts of NOTE_WRITE,
+// NOTE_EXTEND and NOTE_ATTRIB on `p` into a single delivered event after
+// `delay` has elapsed since the last one in the burst, instead of delivering
+// each one as it arrives. A NOTE_DELETE or NOTE_RENAME on `p` flushes any
+// pending coalesced event immediately and is itself never delayed.
+func (k *kqueue) WatchWithDelay(p string, e Event, delay time.Duration) error {
+	if err := k.Watch(p, e); err != nil {
+		return err
+	}
+	k.Lock()
+	if w, ok := k.pthLkp[p]; ok {
+		w.delay = delay
+	}
+	k.Unlock()
+	return nil
+}
+
+// deliver sends or coalesces a single raw kqueue event for `w`, depending on
+// whether `w` has a debounce window configured via WatchWithDelay.
+func (k *kqueue) deliver(w *watched, p string, e Event, kevn *syscall.Kevent_t, rename *RenameEvent) {
+	if w.delay == 0 || e&coalesceMask != e {
+		k.flushDelayed(p)
+		k.c <- &event{w.dir, p, e, kevn, rename}
+		return
+	}
+	k.scheduleDelayed(w, p, e)
+}
+
+// scheduleDelayed folds `e` into the pending coalesced event for `p`,
+// (re)starting the debounce timer so the event is delivered `w.delay` after
+// the last call for `p`.
+func (k *kqueue) scheduleDelayed(w *watched, p string, e Event) {
+	k.pendMu.Lock()
+	defer k.pendMu.Unlock()
+	if k.pend == nil {
+		k.pend = make(map[string]*pending)
+	}
+	if pe, ok := k.pend[p]; ok {
+		pe.e |= e
+		pe.timer.Reset(w.delay)
+		return
+	}
+	pe := &pending{dir: w.dir, e: e}
+	pe.timer = time.AfterFunc(w.delay, func() { k.flushDelayed(p) })
+	k.pend[p] = pe
+}
+
+// flushDelayed delivers and clears the pending coalesced event for `p`, if
+// any. It is safe to call even when nothing is pending.
+//
+// A debounce timer can fire concurrently with Close: by the time it gets
+// here, Close's own timer-stop loop may already have run without seeing
+// this one, since it had not yet removed itself from k.pend, and nothing
+// may be left to drain k.c. Racing the send against k.closed -- which
+// monitor() closes on Close's wakeup, before Close can finish tearing
+// down -- means this either
+// delivers normally or drops the event instead of leaking the goroutine.
+func (k *kqueue) flushDelayed(p string) {
+	k.pendMu.Lock()
+	pe, ok := k.pend[p]
+	if ok {
+		pe.timer.Stop()
+		delete(k.pend, p)
+	}
+	k.pendMu.Unlock()
+	if ok {
+		select {
+		case k.c <- &event{pe.dir, p, pe.e, nil, nil}:
+		case <-k.closed:
+		}
+	}
+}
+
+// handleRename resolves the path a watched node was renamed to, re-keys
+// pthLkp to it and delivers a synthetic Rename event carrying both paths
+// via RenameEvent. `w`'s fd stays open and registered under its existing
+// identifier in idLkp throughout, since kqueue keeps reporting on it after
+// the rename. If the new path cannot be resolved, the failure is reported
+// on Errors() instead and the old path is left in place.
+func (k *kqueue) handleRename(w *watched, kevn *syscall.Kevent_t) {
+	oldPath := w.p
+	newPath, err := resolveRenamedPath(w.fd, w.ino, filepath.Dir(oldPath))
+	if err != nil {
+		k.reportError(&Error{Path: oldPath, Kevent: kevn, Err: err})
+		return
+	}
+	// Any coalesced WatchWithDelay burst is keyed under oldPath; flush it
+	// before re-keying so it is delivered ahead of the Rename instead of
+	// arriving late, under the old path, via its own timer.
+	k.flushDelayed(oldPath)
+	delete(k.pthLkp, oldPath)
+	w.p = newPath
+	k.pthLkp[newPath] = w
+	k.deliver(w, newPath, Rename, kevn, &RenameEvent{OldPath: oldPath, NewPath: newPath})
+}
+
 var errNoNewWatch = errors.New("kqueue: file already watched")
 var errNotWatched = errors.New("kqueue: cannot unwatch not watched file")
 
@@ -200,11 +649,18 @@ var errNotWatched = errors.New("kqueue: cannot unwatch not watched file")
 func (k *kqueue) watch(p string, e Event, direct, dir bool) error {
 	w, ok := k.pthLkp[p]
 	if !ok {
+		if len(k.idLkp) >= maxWatchFds {
+			return errFdBudgetExceeded
+		}
 		fd, err := syscall.Open(p, syscall.O_NONBLOCK|syscall.O_RDONLY, 0)
 		if err != nil {
 			return err
 		}
 		w = &watched{fd: fd, p: p, dir: dir}
+		var st syscall.Stat_t
+		if err := syscall.Fstat(fd, &st); err == nil {
+			w.ino = uint64(st.Ino)
+		}
 	}
 	if direct {
 		w.eDir |= e
@@ -309,8 +765,6 @@ func (k *kqueue) Fanin(c chan<- EventInfo, stop <-chan struct{}) {
 			select {
 			case ei := <-k.c:
 				c <- ei
-				// TODO: Stop monitoring after stop. Verify if closing `kqueue`
-				// file descriptors triggers stop of `Kevent` call.
 			case <-stop:
 				return
 			}
@@ -0,0 +1,220 @@
+// +build darwin dragonfly freebsd netbsd openbsd
+// +build !fsnotify
+
+package notify
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestNewWatcherSizeConfiguresBufSize(t *testing.T) {
+	k := NewWatcherSize(256).(*kqueue)
+	defer k.Close()
+	if k.bufSize != 256 {
+		t.Fatalf("bufSize = %d, want 256", k.bufSize)
+	}
+
+	def := NewWatcherSize(0).(*kqueue)
+	defer def.Close()
+	if def.bufSize != defaultKeventBufSize {
+		t.Fatalf("bufSize = %d, want default %d", def.bufSize, defaultKeventBufSize)
+	}
+}
+
+func TestWatchRecursiveAddsSubdirectories(t *testing.T) {
+	root, err := ioutil.TempDir("", "notify-recursive")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	sub := filepath.Join(root, "a", "b")
+	if err := os.MkdirAll(sub, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	k := newWatcher().(*kqueue)
+	defer k.Close()
+	if err := k.WatchRecursive(root, NOTE_WRITE); err != nil {
+		t.Fatal(err)
+	}
+
+	child := filepath.Join(sub, "c")
+	if err := os.Mkdir(child, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	deadline := time.After(2 * time.Second)
+	for {
+		select {
+		case ei := <-k.c:
+			if ei.Name() == child && ei.Event() == Create {
+				k.Lock()
+				_, ok := k.pthLkp[child]
+				k.Unlock()
+				if !ok {
+					t.Fatalf("watchTree did not register %s after recursive Create", child)
+				}
+				return
+			}
+		case <-deadline:
+			t.Fatalf("timed out waiting for recursive Create on %s", child)
+		}
+	}
+}
+
+func TestWatchWithDelayCoalescesBursts(t *testing.T) {
+	f, err := ioutil.TempFile("", "notify-delay")
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := f.Name()
+	f.Close()
+	defer os.Remove(path)
+
+	k := newWatcher().(*kqueue)
+	defer k.Close()
+	if err := k.WatchWithDelay(path, NOTE_WRITE, 200*time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 5; i++ {
+		if err := ioutil.WriteFile(path, []byte{byte(i)}, 0644); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	select {
+	case ei := <-k.c:
+		if ei.Name() != path {
+			t.Fatalf("event for %s, want %s", ei.Name(), path)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("timed out waiting for coalesced event")
+	}
+
+	select {
+	case ei := <-k.c:
+		t.Fatalf("got a second event %v, burst should have been coalesced into one", ei)
+	case <-time.After(300 * time.Millisecond):
+	}
+}
+
+func TestResolveRenamedPath(t *testing.T) {
+	dir, err := ioutil.TempDir("", "notify-rename")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	// F_GETPATH reports the symlink-resolved path (e.g. /private/var rather
+	// than /var on Darwin), so build the expected paths from the same.
+	if dir, err = filepath.EvalSymlinks(dir); err != nil {
+		t.Fatal(err)
+	}
+
+	oldPath := filepath.Join(dir, "old")
+	newPath := filepath.Join(dir, "new")
+	if err := ioutil.WriteFile(oldPath, []byte("x"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	fd, err := syscall.Open(oldPath, syscall.O_RDONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer syscall.Close(fd)
+
+	var st syscall.Stat_t
+	if err := syscall.Fstat(fd, &st); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.Rename(oldPath, newPath); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := resolveRenamedPath(fd, uint64(st.Ino), dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != newPath {
+		t.Fatalf("resolveRenamedPath = %s, want %s", got, newPath)
+	}
+}
+
+func TestCloseIsIdempotentAndClearsState(t *testing.T) {
+	f, err := ioutil.TempFile("", "notify-close")
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := f.Name()
+	f.Close()
+	defer os.Remove(path)
+
+	k := newWatcher().(*kqueue)
+	if err := k.Watch(path, NOTE_WRITE); err != nil {
+		t.Fatal(err)
+	}
+	if err := k.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := k.Close(); err != nil {
+		t.Fatalf("second Close returned %v, want nil", err)
+	}
+	if len(k.idLkp) != 0 || len(k.pthLkp) != 0 {
+		t.Fatal("Close did not clear watch state")
+	}
+}
+
+func TestCloseStopsPendingDebounceTimers(t *testing.T) {
+	f, err := ioutil.TempFile("", "notify-close-debounce")
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := f.Name()
+	f.Close()
+	defer os.Remove(path)
+
+	k := newWatcher().(*kqueue)
+	if err := k.WatchWithDelay(path, NOTE_WRITE, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path, []byte("x"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	// Give monitor() a moment to observe the write and schedule the debounce
+	// timer before Close tears it down.
+	time.Sleep(100 * time.Millisecond)
+
+	if err := k.Close(); err != nil {
+		t.Fatal(err)
+	}
+	k.pendMu.Lock()
+	n := len(k.pend)
+	k.pendMu.Unlock()
+	if n != 0 {
+		t.Fatalf("Close left %d debounce timer(s) pending", n)
+	}
+}
+
+func TestErrorsChannelDoesNotBlockWhenUndrained(t *testing.T) {
+	k := newWatcher().(*kqueue)
+	defer k.Close()
+	for i := 0; i < cap(k.errs)+1; i++ {
+		done := make(chan struct{})
+		go func() {
+			k.reportError(&Error{Err: errMissingWatch})
+			close(done)
+		}()
+		select {
+		case <-done:
+		case <-time.After(time.Second):
+			t.Fatalf("reportError blocked on send %d with nothing draining Errors()", i)
+		}
+	}
+}